@@ -0,0 +1,35 @@
+package main
+
+// InternEnpointConfig holds the credentials, endpoint and TLS settings
+// shared by every printer's InternEnpoint.
+type InternEnpointConfig struct {
+	Api_app string
+	Api_key string
+	Api_uri string
+
+	// CAFile is a PEM bundle of CAs to trust for Api_uri, instead of the
+	// system roots.
+	CAFile string
+	// ClientCertFile/ClientKeyFile, if set, enable mTLS against intern.
+	ClientCertFile string
+	ClientKeyFile  string
+	// SPKIPin is a base64-encoded SHA-256 SPKI pin accepted as a fallback
+	// when CAFile verification fails.
+	SPKIPin string
+
+	// Insecure disables all certificate verification. Off by default;
+	// only use for local testing against a dev intern instance.
+	Insecure bool
+}
+
+// Config is the top level 3djuggler config file. It now describes a whole
+// office of printers instead of a single one.
+type Config struct {
+	Listen        string
+	InternEnpoint *InternEnpointConfig
+	Printers      []PrinterConfig
+
+	// MaxConcurrentFeeds bounds how many printers may stream gcode over
+	// USB at the same time. 0 means "use the default".
+	MaxConcurrentFeeds int
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/leoleovich/3djuggler/juggler"
+	log "github.com/sirupsen/logrus"
+)
+
+// InternEnpoint talks to the central intern service on behalf of a single
+// printer. Each printer owns its own InternEnpoint so that credentials,
+// in-flight job and logging context never leak across printers.
+type InternEnpoint struct {
+	Api_app string
+	Api_key string
+	Api_uri string
+
+	PrinterName string
+	OfficeName  string
+
+	job *juggler.Job
+	log log.FieldLogger
+
+	client *http.Client
+}
+
+func (ie *InternEnpoint) logger() log.FieldLogger {
+	if ie.log != nil {
+		return ie.log
+	}
+	return log.StandardLogger()
+}
+
+func (ie *InternEnpoint) httpClient() *http.Client {
+	if ie.client != nil {
+		return ie.client
+	}
+	return http.DefaultClient
+}
+
+func (ie *InternEnpoint) authValues() url.Values {
+	v := url.Values{}
+	v.Set("app", ie.Api_app)
+	v.Set("key", ie.Api_key)
+	v.Set("printer", ie.PrinterName)
+	v.Set("office", ie.OfficeName)
+	return v
+}
+
+// nextJob asks intern for the next job queued for this printer and, if
+// there is one, stores it on ie.job and returns found=true. found=false
+// with a nil error means intern simply has nothing queued (HTTP 204),
+// which is the normal idle case and must be distinguished from a genuine
+// transport/5xx failure in err.
+func (ie *InternEnpoint) nextJob() (found bool, err error) {
+	resp, err := ie.httpClient().Get(ie.Api_uri + "/nextjob?" + ie.authValues().Encode())
+	if err != nil {
+		return false, fmt.Errorf("nextJob request to intern failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("nextJob: intern returned %s", resp.Status)
+	}
+
+	job := &juggler.Job{}
+	if err := json.NewDecoder(resp.Body).Decode(job); err != nil {
+		return false, fmt.Errorf("nextJob: can't decode intern response: %v", err)
+	}
+	ie.job = job
+	return true, nil
+}
+
+// getJob refreshes ie.job with the current state of job id as known by
+// intern, e.g. to notice a cancellation requested from the web UI.
+func (ie *InternEnpoint) getJob(id int) error {
+	v := ie.authValues()
+	v.Set("id", fmt.Sprintf("%d", id))
+	resp, err := ie.httpClient().Get(ie.Api_uri + "/job?" + v.Encode())
+	if err != nil {
+		return fmt.Errorf("getJob request to intern failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("getJob: intern returned %s", resp.Status)
+	}
+
+	job := &juggler.Job{}
+	if err := json.NewDecoder(resp.Body).Decode(job); err != nil {
+		return fmt.Errorf("getJob: can't decode intern response: %v", err)
+	}
+	ie.job = job
+	return nil
+}
+
+// reportStat pushes the current job state to intern so it can be surfaced
+// on dashboards.
+func (ie *InternEnpoint) reportStat(job *juggler.Job) error {
+	if job.Local {
+		return nil
+	}
+	body, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("reportStat: can't encode job: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ie.Api_uri+"/stat?"+ie.authValues().Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ie.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("reportStat request to intern failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("reportStat: intern returned %s", resp.Status)
+	}
+	return nil
+}
+
+// deleteJob tells intern that job is done with (finished or cancelled) and
+// can be removed from its active queue.
+func (ie *InternEnpoint) deleteJob(job *juggler.Job) error {
+	if job.Local {
+		return nil
+	}
+	v := ie.authValues()
+	v.Set("id", fmt.Sprintf("%d", job.Id))
+	req, err := http.NewRequest(http.MethodDelete, ie.Api_uri+"/job?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := ie.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("deleteJob request to intern failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("deleteJob: intern returned %s", resp.Status)
+	}
+	return nil
+}
+
+// reschedule is called on startup to recover the printer's last known job,
+// if any, from intern.
+func (ie *InternEnpoint) reschedule() error {
+	_, err := ie.nextJob()
+	return err
+}
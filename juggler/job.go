@@ -0,0 +1,68 @@
+// Package juggler holds the data types shared between 3djuggler and the
+// intern job scheduling service.
+package juggler
+
+import (
+	"time"
+
+	"github.com/leoleovich/go-gcodefeeder/gcodefeeder"
+)
+
+// Status describes where a Job currently sits in the print pipeline.
+type Status int
+
+const (
+	StatusWaitingJob Status = iota
+	StatusWaitingButton
+	StatusSending
+	StatusPrinting
+	StatusCancelling
+	StatusFinished
+	StatusButtonTimeout
+	StatusInterrupted
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusWaitingJob:
+		return "WaitingJob"
+	case StatusWaitingButton:
+		return "WaitingButton"
+	case StatusSending:
+		return "Sending"
+	case StatusPrinting:
+		return "Printing"
+	case StatusCancelling:
+		return "Cancelling"
+	case StatusFinished:
+		return "Finished"
+	case StatusButtonTimeout:
+		return "ButtonTimeout"
+	case StatusInterrupted:
+		return "Interrupted"
+	default:
+		return "Unknown"
+	}
+}
+
+// Job is a single print job as handed to us by intern.
+type Job struct {
+	Id          int
+	Filename    string
+	FileContent string
+	Owner       string
+	// Status is the flat status enum. Deprecated: superseded by State,
+	// which also carries a cause; kept and dual-emitted for one release
+	// so intern has time to migrate to reading State.
+	Status       Status
+	State        JobState
+	Progress     float64
+	FeederStatus gcodefeeder.Status
+	Fetched      time.Time
+	Scheduled    time.Time
+
+	// Local is set for jobs submitted directly over the LAN (privet)
+	// instead of fetched from intern; such jobs are never reported back
+	// to intern.
+	Local bool
+}
@@ -0,0 +1,57 @@
+package juggler
+
+import "time"
+
+// ServiceActionCause explains, from intern's point of view, why a job
+// transitioned into its current state - modeled on the errorCode field
+// cloud print connectors attach to a STOPPED/ABORTED job (e.g.
+// PRINTER_DELETED, INVALID_TICKET).
+type ServiceActionCause string
+
+const (
+	ServiceCauseNone              ServiceActionCause = ""
+	ServiceCauseCancelled         ServiceActionCause = "CANCELLED"
+	ServiceCauseUserActionTimeout ServiceActionCause = "USER_ACTION_TIMEOUT"
+)
+
+// DeviceActionCause explains why the printer itself drove a transition,
+// as opposed to intern or a user action.
+type DeviceActionCause string
+
+const (
+	DeviceCauseNone              DeviceActionCause = ""
+	DeviceCauseCancelledAtDevice DeviceActionCause = "CANCELLED_AT_DEVICE"
+	DeviceCauseFeederError       DeviceActionCause = "FEEDER_ERROR"
+	DeviceCauseDaemonShutdown    DeviceActionCause = "DAEMON_SHUTDOWN"
+)
+
+// JobState is a structured job status: not just which state a job is in,
+// but why it got there and, where relevant, what to show a user. It
+// supersedes the flat Status enum on Job so intern can surface actionable
+// errors instead of an opaque number.
+type JobState struct {
+	Type               Status
+	ServiceCause       ServiceActionCause
+	DeviceCause        DeviceActionCause
+	UserVisibleMessage string
+	At                 time.Time
+}
+
+// NewState starts a plain transition to t with no cause attached.
+func NewState(t Status) JobState {
+	return JobState{Type: t, At: time.Now()}
+}
+
+// WithServiceCause attaches an intern-side reason to the state.
+func (s JobState) WithServiceCause(cause ServiceActionCause, msg string) JobState {
+	s.ServiceCause = cause
+	s.UserVisibleMessage = msg
+	return s
+}
+
+// WithDeviceCause attaches a printer-side reason to the state.
+func (s JobState) WithDeviceCause(cause DeviceActionCause, msg string) JobState {
+	s.DeviceCause = cause
+	s.UserVisibleMessage = msg
+	return s
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/leoleovich/3djuggler/scheduler"
+	"github.com/leoleovich/3djuggler/workerpool"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultMaxConcurrentFeeds bounds how many printers may stream gcode over
+// USB at once when Config.MaxConcurrentFeeds isn't set.
+const defaultMaxConcurrentFeeds = 4
+
+// PrinterManager supervises every printer configured for this 3djuggler
+// process, each running its own state machine in its own goroutine, and
+// routes the HTTP API to the right one via a printer= selector.
+type PrinterManager struct {
+	printers map[string]*Printer
+
+	wg sync.WaitGroup
+}
+
+// NewPrinterManager builds a printer and its InternEnpoint for every entry
+// in cfg.Printers, sharing a single feed worker pool across all of them.
+func NewPrinterManager(cfg *Config) (*PrinterManager, error) {
+	if len(cfg.Printers) == 0 {
+		return nil, fmt.Errorf("config has no printers configured")
+	}
+	if cfg.InternEnpoint == nil {
+		return nil, fmt.Errorf("config has no InternEnpoint configured")
+	}
+
+	maxConcurrentFeeds := cfg.MaxConcurrentFeeds
+	if maxConcurrentFeeds <= 0 {
+		maxConcurrentFeeds = defaultMaxConcurrentFeeds
+	}
+	feedPool := workerpool.New(maxConcurrentFeeds)
+
+	client, err := newInternHTTPClient(cfg.InternEnpoint)
+	if err != nil {
+		return nil, fmt.Errorf("can't build intern TLS client: %v", err)
+	}
+
+	m := &PrinterManager{printers: make(map[string]*Printer)}
+	for _, pc := range cfg.Printers {
+		if _, exists := m.printers[pc.Name]; exists {
+			return nil, fmt.Errorf("duplicate printer name %q", pc.Name)
+		}
+		ie := &InternEnpoint{
+			Api_app:     cfg.InternEnpoint.Api_app,
+			Api_key:     cfg.InternEnpoint.Api_key,
+			Api_uri:     cfg.InternEnpoint.Api_uri,
+			PrinterName: pc.Name,
+			OfficeName:  pc.Office,
+			client:      client,
+			log:         log.WithField("printer", pc.Name),
+		}
+		queue, err := scheduler.Open(pc.QueueDir)
+		if err != nil {
+			return nil, fmt.Errorf("printer %q: %v", pc.Name, err)
+		}
+		m.printers[pc.Name] = NewPrinter(pc, ie, feedPool, queue)
+	}
+	return m, nil
+}
+
+// Run starts every printer's state machine and blocks until ctx is
+// cancelled and all of them have returned.
+func (m *PrinterManager) Run(ctx context.Context) {
+	for _, p := range m.printers {
+		p := p
+		if err := p.ie.reschedule(); err != nil {
+			p.log.Error("reschedule failed: ", err)
+		}
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			p.Run(ctx)
+		}()
+	}
+	m.wg.Wait()
+}
+
+func (m *PrinterManager) printer(r *http.Request) (*Printer, error) {
+	name := r.URL.Query().Get("printer")
+	if name == "" {
+		if len(m.printers) == 1 {
+			for _, p := range m.printers {
+				return p, nil
+			}
+		}
+		return nil, fmt.Errorf("printer= parameter is required when multiple printers are configured")
+	}
+	p, ok := m.printers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown printer %q", name)
+	}
+	return p, nil
+}
+
+func (m *PrinterManager) InfoHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := m.printer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.writeInfo(w)
+}
+
+func (m *PrinterManager) StartHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := m.printer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.start(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	p.writeInfo(w)
+}
+
+func (m *PrinterManager) RescheduleHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := m.printer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if at := r.URL.Query().Get("at"); at != "" {
+		scheduled, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid at= time, want RFC3339: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := p.deferJob(scheduled); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		p.writeInfo(w)
+		return
+	}
+
+	if err := p.ie.reschedule(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.writeInfo(w)
+}
+
+func (m *PrinterManager) CancelHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := m.printer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.cancel()
+	p.writeInfo(w)
+}
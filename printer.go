@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/leoleovich/3djuggler/juggler"
+	"github.com/leoleovich/3djuggler/scheduler"
+	"github.com/leoleovich/3djuggler/workerpool"
+	"github.com/leoleovich/go-gcodefeeder/gcodefeeder"
+	log "github.com/sirupsen/logrus"
+)
+
+// PrinterConfig describes a single printer 3djuggler should drive. A
+// process is given one of these per physical printer in Config.Printers.
+type PrinterConfig struct {
+	Name            string
+	Office          string
+	SerialDevice    string
+	Gizmostatusfile string
+	Buttonfile      string
+	Jobfile         string
+
+	// QueueDir holds the persistent journal of jobs deferred via
+	// /reschedule?at=... (see scheduler.Queue).
+	QueueDir string
+
+	// Capabilities advertised over privet/mDNS for local LAN submission.
+	BedSizeX  float64
+	BedSizeY  float64
+	BedSizeZ  float64
+	Materials []string
+}
+
+// Printer is the state machine for a single physical printer: it owns its
+// serial device, its intern session and its on-disk status files. A
+// PrinterManager runs one Printer per configured printer, each in its own
+// goroutine.
+type Printer struct {
+	name   string
+	office string
+
+	serialDevice    string
+	buttonfile      string
+	gizmostatusfile string
+	jobfile         string
+
+	bedSizeX, bedSizeY, bedSizeZ float64
+	materials                    []string
+
+	timer  *time.Timer
+	job    *juggler.Job
+	ie     *InternEnpoint
+	feeder *gcodefeeder.Feeder
+
+	feedPool *workerpool.Pool
+
+	// queue holds jobs deferred to a later time (see scheduler.Queue and
+	// /reschedule?at=...). queueTimer always reflects the next-due one so
+	// the printer wakes up exactly when it becomes due instead of waiting
+	// for the next poll.
+	queue          *scheduler.Queue
+	queueTimer     *time.Timer
+	nextJobBackoff time.Duration
+
+	// localJobs receives jobs submitted directly over the LAN (see
+	// privet.go), bypassing intern entirely.
+	localJobs chan *juggler.Job
+
+	// cmds carries reads and actions requested by HTTP handlers onto the
+	// state machine goroutine, the same way localJobs hands off local
+	// submissions, so job and feeder are never touched from two goroutines
+	// at once.
+	cmds chan func()
+
+	// tokens holds outstanding privet access tokens, see privet.go.
+	tokensMu sync.Mutex
+	tokens   map[string]privetToken
+
+	log log.FieldLogger
+}
+
+// NewPrinter builds a Printer from its static config. feedPool is shared
+// across all printers in the manager so at most a handful of them can be
+// streaming gcode over USB at once.
+func NewPrinter(cfg PrinterConfig, ie *InternEnpoint, feedPool *workerpool.Pool, queue *scheduler.Queue) *Printer {
+	p := &Printer{
+		name:            cfg.Name,
+		office:          cfg.Office,
+		serialDevice:    cfg.SerialDevice,
+		buttonfile:      cfg.Buttonfile,
+		gizmostatusfile: cfg.Gizmostatusfile,
+		jobfile:         cfg.Jobfile,
+		bedSizeX:        cfg.BedSizeX,
+		bedSizeY:        cfg.BedSizeY,
+		bedSizeZ:        cfg.BedSizeZ,
+		materials:       cfg.Materials,
+		timer:           time.NewTimer(0),
+		job:             &juggler.Job{Status: juggler.StatusWaitingJob},
+		ie:              ie,
+		feedPool:        feedPool,
+		queue:           queue,
+		queueTimer:      time.NewTimer(time.Hour),
+		nextJobBackoff:  pollingInterval,
+		localJobs:       make(chan *juggler.Job, 1),
+		cmds:            make(chan func()),
+		log:             log.WithField("printer", cfg.Name),
+	}
+	p.rearmQueueTimer()
+	return p
+}
+
+// rearmQueueTimer resets queueTimer so it next fires exactly when the
+// earliest queued job becomes due, or idles for a while if the queue is
+// empty.
+func (p *Printer) rearmQueueTimer() {
+	if !p.queueTimer.Stop() {
+		select {
+		case <-p.queueTimer.C:
+		default:
+		}
+	}
+	if next, ok := p.queue.Next(); ok {
+		d := time.Until(next)
+		if d < 0 {
+			d = 0
+		}
+		p.queueTimer.Reset(d)
+	} else {
+		p.queueTimer.Reset(time.Hour)
+	}
+}
+
+// wakeNow arranges for the main poll timer to fire immediately.
+func (p *Printer) wakeNow() {
+	if !p.timer.Stop() {
+		select {
+		case <-p.timer.C:
+		default:
+		}
+	}
+	p.timer.Reset(0)
+}
+
+// nextBackoff doubles d, capped at maxNextJobBackoff, so repeated
+// ie.nextJob() failures back off instead of hammering intern at the fixed
+// pollingInterval.
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > maxNextJobBackoff {
+		d = maxNextJobBackoff
+	}
+	if d < pollingInterval {
+		d = pollingInterval
+	}
+	return d
+}
+
+// deferJob takes the printer's current job out of circulation and queues
+// it to become due again at "at", per an explicit /reschedule?at=... call.
+// It runs on the state machine goroutine, since it touches queueTimer and
+// job exactly like a tick does and can't safely race one.
+func (p *Printer) deferJob(at time.Time) error {
+	errCh := make(chan error, 1)
+	p.cmds <- func() {
+		if p.job.Id == 0 {
+			errCh <- fmt.Errorf("no active job to defer")
+			return
+		}
+		deferred := *p.job
+		if err := p.queue.Push(&deferred, at); err != nil {
+			errCh <- err
+			return
+		}
+		p.rearmQueueTimer()
+
+		p.job.Id = 0
+		p.UpdateStatus(juggler.NewState(juggler.StatusWaitingJob))
+		os.Remove(p.gizmostatusfile)
+		errCh <- nil
+	}
+	return <-errCh
+}
+
+func (p *Printer) checkButtonPressed() bool {
+	if _, err := os.Stat(p.buttonfile); err == nil {
+		os.Remove(p.buttonfile)
+		return true
+	}
+	return false
+}
+
+// UpdateStatus moves the job to state, attaching whatever cause the caller
+// knows about. It dual-emits the deprecated flat Status field alongside
+// State for one release while intern migrates to reading the latter.
+func (p *Printer) UpdateStatus(state juggler.JobState) {
+	p.job.State = state
+	p.job.Status = state.Type
+}
+
+// beginJob takes a freshly fetched (from intern or submitted locally) job
+// and moves the printer into StatusWaitingButton, setting up the status
+// files the device polls to notice a pending print.
+func (p *Printer) beginJob(j *juggler.Job) {
+	p.job.Id = j.Id
+	p.job.Filename = j.Filename
+	p.job.FileContent = j.FileContent
+	p.job.Progress = j.Progress
+	p.job.Owner = j.Owner
+	p.job.Local = j.Local
+	p.job.Fetched = time.Now()
+	p.job.Scheduled = time.Now().Add(waitingForButtonInterval)
+
+	os.Remove(p.buttonfile)
+	os.Remove(p.gizmostatusfile)
+
+	emptyFile, err := os.Create(p.gizmostatusfile)
+	if err != nil {
+		p.log.Error("Unable to create gizmostatusfile: ", err)
+	}
+	emptyFile.Close()
+	if err := os.Chmod(p.gizmostatusfile, 0666); err != nil {
+		p.log.Error("Unable to chmod gizmostatusfile: ", err)
+	}
+
+	p.UpdateStatus(juggler.NewState(juggler.StatusWaitingButton))
+}
+
+// Run drives the printer's state machine until ctx is cancelled. It is the
+// direct descendant of the single-printer loop that used to live at the
+// bottom of main(). On cancellation it shuts the printer down gracefully
+// before returning.
+func (p *Printer) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			p.shutdown()
+			return
+		case <-p.queueTimer.C:
+			// A queued job just became due; wake the main tick early so
+			// the StatusWaitingJob branch can drain it right away instead
+			// of waiting out the rest of pollingInterval.
+			p.wakeNow()
+		case localJob := <-p.localJobs:
+			if p.job.Status != juggler.StatusWaitingJob {
+				p.log.Warning("Rejecting local job submission, printer is busy")
+				break
+			}
+			p.log.Info("Accepted local job submission from ", localJob.Owner)
+			p.beginJob(localJob)
+		case cmd := <-p.cmds:
+			cmd()
+		case <-p.timer.C:
+			p.timer.Reset(pollingInterval)
+			if err := p.ie.reportStat(p.job); err != nil {
+				p.log.Error(err)
+			}
+			p.log.Info("My status is: ", p.job.Status)
+
+			switch p.job.Status {
+			case juggler.StatusWaitingJob:
+				job, dueFromQueue := p.queue.PopDue(time.Now())
+				if dueFromQueue {
+					p.log.Info("Draining queued job ", job.Id, " scheduled for earlier")
+					p.rearmQueueTimer()
+				} else {
+					found, err := p.ie.nextJob()
+					if err != nil {
+						p.log.Error(err)
+						p.nextJobBackoff = nextBackoff(p.nextJobBackoff)
+						p.log.Info("Backing off ie.nextJob() for ", p.nextJobBackoff)
+						p.timer.Reset(p.nextJobBackoff)
+						break
+					}
+					if !found {
+						// Intern simply has nothing queued; that's the
+						// normal idle case, not a failure, so keep polling
+						// at the fixed interval instead of backing off.
+						p.nextJobBackoff = pollingInterval
+						break
+					}
+					job = p.ie.job
+				}
+				p.nextJobBackoff = pollingInterval
+				p.beginJob(job)
+				fallthrough
+
+			case juggler.StatusWaitingButton:
+				p.log.Info("Job ", p.job.Id, " is waiting")
+				var err error
+				if p.job.Local {
+					// Local jobs aren't tracked by intern, so only a
+					// device-side cancel (gizmostatusfile removed) applies.
+				} else {
+					err = p.ie.getJob(p.job.Id)
+					if err != nil {
+						p.log.Error("Can't get job status from intern: ", err)
+					} else {
+						p.log.Info("Job status on intern: ", p.ie.job.Status)
+					}
+					if err == nil && p.ie.job.Status == juggler.StatusCancelling {
+						p.log.Info("The job is cancelling")
+						p.UpdateStatus(juggler.NewState(juggler.StatusCancelling).
+							WithServiceCause(juggler.ServiceCauseCancelled, "Cancelled via intern"))
+						break
+					}
+				}
+
+				gizmostatusfileStat, err := os.Stat(p.gizmostatusfile)
+				if err != nil {
+					p.log.Info("Job was canceled through device, canceling")
+					p.UpdateStatus(juggler.NewState(juggler.StatusCancelling).
+						WithDeviceCause(juggler.DeviceCauseCancelledAtDevice, "Job was cancelled at the printer"))
+				} else if gizmostatusfileStat.ModTime().Add(waitingForButtonInterval).After(time.Now()) {
+					if p.checkButtonPressed() {
+						p.UpdateStatus(juggler.NewState(juggler.StatusSending))
+					} else {
+						p.log.Info("Waiting ", gizmostatusfileStat.ModTime().Add(waitingForButtonInterval).Unix()-time.Now().Unix(), " more seconds for somebody to press the button")
+					}
+				} else if p.job.Scheduled.After(time.Now()) {
+					p.log.Info("Waiting ", p.job.Scheduled.Unix()-time.Now().Unix(), " more seconds for somebody to press the button")
+				} else {
+					p.log.Warning("Nobody pressed the button on time")
+					p.UpdateStatus(juggler.NewState(juggler.StatusButtonTimeout).
+						WithServiceCause(juggler.ServiceCauseUserActionTimeout, "Nobody pressed the button in time"))
+					p.log.Warning("Timeout while waiting for a job. Switching back to ", juggler.StatusWaitingJob)
+					p.UpdateStatus(juggler.NewState(juggler.StatusWaitingJob))
+					p.job.Id = 0
+					os.Remove(p.gizmostatusfile)
+				}
+
+			case juggler.StatusSending:
+				p.log.Info("Sending to printer")
+				p.log.Debug("FileSize: ", len(p.job.FileContent))
+				if err := ioutil.WriteFile(p.jobfile, []byte(p.job.FileContent), 0644); err != nil {
+					p.log.Error(err)
+					break
+				}
+
+				feeder, err := gcodefeeder.NewFeeder(p.serialDevice, p.jobfile)
+				if err != nil {
+					p.log.Error("Failed to create Feeder: ", err)
+					break
+				}
+				p.feeder = feeder
+				p.UpdateStatus(juggler.NewState(juggler.StatusPrinting))
+
+				// Acquire the feed slot inside the spawned goroutine, not
+				// here: with MaxConcurrentFeeds printers already streaming,
+				// blocking here would stall this printer's whole state
+				// machine - ctx.Done, cmds, localJobs, queueTimer - for as
+				// long as another printer's print takes.
+				go p.feedPool.Do(p.feeder.Feed)
+
+			case juggler.StatusPrinting:
+				p.log.Info("Job ", p.job.Id, " is currently in progress")
+
+				if _, err := os.Stat(p.gizmostatusfile); os.IsNotExist(err) {
+					p.log.Warning("Was canceled through device. Canceling")
+					p.feeder.Cancel()
+					p.UpdateStatus(juggler.NewState(juggler.StatusCancelling).
+						WithDeviceCause(juggler.DeviceCauseCancelledAtDevice, "Job was cancelled at the printer"))
+					break
+				}
+
+				if !p.job.Local {
+					err := p.ie.getJob(p.job.Id)
+					if err != nil {
+						p.log.Error("Can't get job status from intern: ", err)
+					}
+					if err == nil && p.ie.job.Status == juggler.StatusCancelling {
+						p.log.Info("Cancelling the job")
+						p.UpdateStatus(juggler.NewState(juggler.StatusCancelling).
+							WithServiceCause(juggler.ServiceCauseCancelled, "Cancelled via intern"))
+						p.feeder.Cancel()
+						break
+					}
+				}
+				p.job.Progress = float64(p.feeder.Progress())
+				p.job.FeederStatus = p.feeder.Status()
+				switch p.job.FeederStatus {
+				case gcodefeeder.Finished:
+					p.UpdateStatus(juggler.NewState(juggler.StatusFinished))
+				case gcodefeeder.Error:
+					p.UpdateStatus(juggler.NewState(juggler.StatusCancelling).
+						WithDeviceCause(juggler.DeviceCauseFeederError, "The gcode feeder reported an error"))
+				default:
+					p.UpdateStatus(juggler.NewState(p.job.State.Type))
+				}
+
+			case juggler.StatusCancelling:
+				fallthrough
+			case juggler.StatusFinished:
+				p.log.Info("Deleting from intern")
+				if err := p.ie.deleteJob(p.job); err != nil {
+					p.log.Error(err)
+				}
+				p.job.Id = 0
+				p.UpdateStatus(juggler.NewState(juggler.StatusWaitingJob))
+				os.Remove(p.gizmostatusfile)
+			default:
+				p.log.Error("Job ", p.job, " is in a weird state")
+			}
+		}
+	}
+}
+
+// shutdown brings the printer to a safe stop: it cancels any in-flight
+// print, tells intern the job was interrupted rather than letting it sit
+// orphaned, and cleans up the status files a device might still be polling.
+func (p *Printer) shutdown() {
+	p.log.Info("Shutting down")
+
+	if p.job.Status == juggler.StatusPrinting && p.feeder != nil {
+		p.log.Info("Cancelling in-flight print for shutdown")
+		p.feeder.Cancel()
+
+		deadline := time.Now().Add(shutdownFeederTimeout)
+		for time.Now().Before(deadline) {
+			status := p.feeder.Status()
+			if status == gcodefeeder.Finished || status == gcodefeeder.Error {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	if p.job.Status == juggler.StatusPrinting || p.job.Status == juggler.StatusSending ||
+		p.job.Status == juggler.StatusWaitingButton {
+		p.UpdateStatus(juggler.NewState(juggler.StatusInterrupted).
+			WithDeviceCause(juggler.DeviceCauseDaemonShutdown, "The 3djuggler daemon was shut down"))
+		if err := p.ie.reportStat(p.job); err != nil {
+			p.log.Error("Failed to report interrupted status to intern: ", err)
+		}
+	}
+
+	os.Remove(p.gizmostatusfile)
+	os.Remove(p.jobfile)
+}
+
+// snapshotJob copies the current job on the state machine goroutine, so
+// HTTP handlers never read it concurrently with a tick that's mutating it.
+func (p *Printer) snapshotJob() *juggler.Job {
+	reply := make(chan *juggler.Job, 1)
+	p.cmds <- func() {
+		j := *p.job
+		reply <- &j
+	}
+	return <-reply
+}
+
+// start emulates a physical button press via the API: it advances a job
+// that's waiting on one into StatusSending, just like checkButtonPressed
+// would. It runs on the state machine goroutine so it can't race a tick
+// that's concurrently touching job.
+func (p *Printer) start() error {
+	errCh := make(chan error, 1)
+	p.cmds <- func() {
+		if p.job.State.Type != juggler.StatusWaitingButton {
+			errCh <- fmt.Errorf("job %d is not waiting for the button (status: %s)", p.job.Id, p.job.State.Type)
+			return
+		}
+		p.UpdateStatus(juggler.NewState(juggler.StatusSending))
+		errCh <- nil
+	}
+	return <-errCh
+}
+
+// cancel requests that the in-flight job be cancelled. It runs on the state
+// machine goroutine so it can't race a tick that's concurrently touching
+// job or feeder.
+func (p *Printer) cancel() {
+	done := make(chan struct{})
+	p.cmds <- func() {
+		if p.feeder != nil {
+			p.feeder.Cancel()
+		}
+		p.UpdateStatus(juggler.NewState(juggler.StatusCancelling).
+			WithServiceCause(juggler.ServiceCauseCancelled, "Cancelled via API"))
+		close(done)
+	}
+	<-done
+}
+
+func (p *Printer) writeInfo(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.snapshotJob())
+}
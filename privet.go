@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/leoleovich/3djuggler/juggler"
+	log "github.com/sirupsen/logrus"
+)
+
+// privetTokenTTL is how long a privet access token stays valid once issued.
+// It is intentionally short: a token is meant to be used right after it was
+// requested, by someone standing next to the printer.
+var privetTokenTTL = 5 * time.Minute
+
+// privetToken is a short-lived proximity token binding a submitdoc call to
+// the user who requested it, modeled on Google's Privet /accesstoken.
+type privetToken struct {
+	user    string
+	expires time.Time
+}
+
+// privetInfo is the shape returned by /privet/info: capabilities plus
+// current state, enough for a LAN client to decide whether to submit.
+type privetInfo struct {
+	Version         string     `json:"version"`
+	Name            string     `json:"name"`
+	Office          string     `json:"office"`
+	Status          string     `json:"status"`
+	BedSize         [3]float64 `json:"bed_size_mm"`
+	Materials       []string   `json:"materials"`
+	ConnectionState string     `json:"connection_state"`
+}
+
+func (p *Printer) privetInfo() privetInfo {
+	job := p.snapshotJob()
+	return privetInfo{
+		Version:         "1.0",
+		Name:            p.name,
+		Office:          p.office,
+		Status:          job.Status.String(),
+		BedSize:         [3]float64{p.bedSizeX, p.bedSizeY, p.bedSizeZ},
+		Materials:       p.materials,
+		ConnectionState: "online",
+	}
+}
+
+func (p *Printer) issueAccessToken(user string) string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	token := hex.EncodeToString(buf)
+
+	p.tokensMu.Lock()
+	if p.tokens == nil {
+		p.tokens = make(map[string]privetToken)
+	}
+	p.tokens[token] = privetToken{user: user, expires: time.Now().Add(privetTokenTTL)}
+	p.tokensMu.Unlock()
+
+	return token
+}
+
+func (p *Printer) checkAccessToken(token string) (string, bool) {
+	p.tokensMu.Lock()
+	defer p.tokensMu.Unlock()
+
+	t, ok := p.tokens[token]
+	if !ok {
+		return "", false
+	}
+	delete(p.tokens, token)
+	if time.Now().After(t.expires) {
+		return "", false
+	}
+	return t.user, true
+}
+
+// submitLocalDoc synthesizes a juggler.Job from an uploaded gcode file and
+// hands it to the printer's state machine exactly as nextJob() would,
+// except the resulting job is marked Local so it's never reported back to
+// intern. Like any other job, it still has to wait for someone to press
+// the physical button before printing starts.
+func (p *Printer) submitLocalDoc(owner, filename string, content []byte) error {
+	job := &juggler.Job{
+		Filename:    filename,
+		FileContent: string(content),
+		Owner:       owner,
+		Local:       true,
+	}
+	select {
+	case p.localJobs <- job:
+		return nil
+	default:
+		return fmt.Errorf("a local job is already pending submission")
+	}
+}
+
+func (m *PrinterManager) PrivetInfoHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := m.printer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.privetInfo())
+}
+
+func (m *PrinterManager) PrivetAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := m.printer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		http.Error(w, "user= parameter is required", http.StatusBadRequest)
+		return
+	}
+	token := p.issueAccessToken(user)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      token,
+		"expires_in": int(privetTokenTTL.Seconds()),
+	})
+}
+
+func (m *PrinterManager) PrivetSubmitDocHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := m.printer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token := r.URL.Query().Get("accesstoken")
+	user, ok := p.checkAccessToken(token)
+	if !ok {
+		http.Error(w, "missing or expired accesstoken", http.StatusUnauthorized)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("missing gcode upload: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("can't read upload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := p.submitLocalDoc(user, header.Filename, content); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (m *PrinterManager) PrivetJobStateHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := m.printer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.writeInfo(w)
+}
+
+// registerMDNS advertises every printer over mDNS as _3djuggler._tcp so
+// clients on the same LAN can discover it without going through intern.
+// The returned shutdown func unregisters all of them and must be called
+// before the process exits.
+func registerMDNS(ctx context.Context, m *PrinterManager, listenPort int) (func(), error) {
+	var servers []*zeroconf.Server
+	for name, p := range m.printers {
+		txt := []string{
+			fmt.Sprintf("office=%s", p.office),
+			fmt.Sprintf("status=%s", p.job.Status.String()),
+			fmt.Sprintf("bed_size_mm=%gx%gx%g", p.bedSizeX, p.bedSizeY, p.bedSizeZ),
+			fmt.Sprintf("materials=%s", strings.Join(p.materials, ",")),
+		}
+		srv, err := zeroconf.Register(name, "_3djuggler._tcp", "local.", listenPort, txt, nil)
+		if err != nil {
+			for _, s := range servers {
+				s.Shutdown()
+			}
+			return nil, fmt.Errorf("mDNS registration for %q failed: %v", name, err)
+		}
+		servers = append(servers, srv)
+	}
+
+	log.Info("Registered ", len(servers), " printer(s) on mDNS as _3djuggler._tcp")
+
+	return func() {
+		for _, s := range servers {
+			s.Shutdown()
+		}
+	}, nil
+}
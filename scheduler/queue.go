@@ -0,0 +1,166 @@
+// Package scheduler provides a persistent min-heap of jobs that aren't due
+// to print yet, so a job can be deferred (off-hours prints, material
+// changes, quiet hours) without losing it if the daemon restarts.
+package scheduler
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/leoleovich/3djuggler/juggler"
+)
+
+type entry struct {
+	Job       *juggler.Job
+	Scheduled time.Time
+}
+
+type entryHeap []*entry
+
+func (h entryHeap) Len() int            { return len(h) }
+func (h entryHeap) Less(i, j int) bool  { return h[i].Scheduled.Before(h[j].Scheduled) }
+func (h entryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *entryHeap) Push(x interface{}) { *h = append(*h, x.(*entry)) }
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
+
+// journalOp is one line of the on-disk journal.
+type journalOp struct {
+	Op        string       `json:"op"` // "push" or "pop"
+	Job       *juggler.Job `json:"job,omitempty"`
+	Scheduled time.Time    `json:"scheduled,omitempty"`
+	JobId     int          `json:"job_id,omitempty"`
+}
+
+// Queue is a persistent min-heap of jobs keyed on their Scheduled time. It
+// journals every push/pop to a JSON-lines file under its queue_dir so the
+// pending jobs survive a daemon restart.
+type Queue struct {
+	mu   sync.Mutex
+	heap entryHeap
+
+	journalPath string
+	journal     *os.File
+}
+
+// Open loads queue_dir/queue.jsonl (replaying it to rebuild the heap) and
+// keeps it open for further appends.
+func Open(queueDir string) (*Queue, error) {
+	if err := os.MkdirAll(queueDir, 0755); err != nil {
+		return nil, fmt.Errorf("can't create queue_dir: %v", err)
+	}
+	path := filepath.Join(queueDir, "queue.jsonl")
+
+	q := &Queue{journalPath: path}
+	if err := q.replay(); err != nil {
+		return nil, fmt.Errorf("can't replay queue journal: %v", err)
+	}
+	heap.Init(&q.heap)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("can't open queue journal: %v", err)
+	}
+	q.journal = f
+	return q, nil
+}
+
+func (q *Queue) replay() error {
+	f, err := os.Open(q.journalPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pending := make(map[int]*entry)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var op journalOp
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+			// Tolerate a torn last line from a crash mid-write.
+			continue
+		}
+		switch op.Op {
+		case "push":
+			pending[op.Job.Id] = &entry{Job: op.Job, Scheduled: op.Scheduled}
+		case "pop":
+			delete(pending, op.JobId)
+		}
+	}
+	for _, e := range pending {
+		q.heap = append(q.heap, e)
+	}
+	return scanner.Err()
+}
+
+func (q *Queue) appendOp(op journalOp) error {
+	b, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = q.journal.Write(b)
+	return err
+}
+
+// Push schedules job to become due at "at".
+func (q *Queue) Push(job *juggler.Job, at time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.appendOp(journalOp{Op: "push", Job: job, Scheduled: at}); err != nil {
+		return fmt.Errorf("can't journal push: %v", err)
+	}
+	heap.Push(&q.heap, &entry{Job: job, Scheduled: at})
+	return nil
+}
+
+// Next returns the scheduled time of the earliest queued job.
+func (q *Queue) Next() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.heap) == 0 {
+		return time.Time{}, false
+	}
+	return q.heap[0].Scheduled, true
+}
+
+// PopDue removes and returns the earliest job if it's due by now.
+func (q *Queue) PopDue(now time.Time) (*juggler.Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.heap) == 0 || q.heap[0].Scheduled.After(now) {
+		return nil, false
+	}
+	e := heap.Pop(&q.heap).(*entry)
+	if err := q.appendOp(journalOp{Op: "pop", JobId: e.Job.Id}); err != nil {
+		// The job is already out of the in-memory heap; losing the pop
+		// record just means a restart could see it as still queued, which
+		// is the safer failure mode than dropping it silently.
+		return e.Job, true
+	}
+	return e.Job, true
+}
+
+// Close closes the journal file.
+func (q *Queue) Close() error {
+	return q.journal.Close()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// watchShutdownSignals cancels the given cancel func on the first
+// SIGINT/SIGTERM/SIGHUP so the daemon can shut down gracefully, and forces
+// an immediate exit on a second signal in case something is stuck.
+func watchShutdownSignals(cancel func()) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	go func() {
+		s := <-sig
+		log.Infof("Got signal %v, shutting down gracefully", s)
+		cancel()
+
+		s = <-sig
+		log.Fatalf("Got second signal %v, forcing exit", s)
+	}()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// newInternHTTPClient builds the *http.Client used for every request to
+// intern. Unlike the old global InsecureSkipVerify, this only affects
+// intern traffic and defaults to verifying the server the normal way.
+func newInternHTTPClient(cfg *InternEnpointConfig) (*http.Client, error) {
+	if cfg.Insecure {
+		log.Warning("InternEnpoint.Insecure is set: TLS certificate verification is disabled for intern requests")
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	var roots *x509.CertPool
+
+	if cfg.CAFile != "" {
+		caCert, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read CAFile: %v", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in CAFile %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if cfg.ClientCertFile != "" || cfg.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load ClientCertFile/ClientKeyFile: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.SPKIPin != "" {
+		// The stdlib has no "verify via RootCAs OR this pin" mode, so we
+		// take over verification: try the configured CA first and fall
+		// back to an exact SPKI pin match.
+		tlsConfig.InsecureSkipVerify = true
+		pin := cfg.SPKIPin
+		var apiHost string
+		if u, err := url.Parse(cfg.Api_uri); err == nil {
+			apiHost = u.Hostname()
+		}
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, 0, len(rawCerts))
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return fmt.Errorf("can't parse peer certificate: %v", err)
+				}
+				certs = append(certs, cert)
+			}
+			if len(certs) == 0 {
+				return fmt.Errorf("no peer certificates presented")
+			}
+
+			if roots != nil {
+				intermediates := x509.NewCertPool()
+				for _, c := range certs[1:] {
+					intermediates.AddCert(c)
+				}
+				if _, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, DNSName: apiHost}); err == nil {
+					return nil
+				}
+			}
+
+			for _, c := range certs {
+				sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+				if base64.StdEncoding.EncodeToString(sum[:]) == pin {
+					return nil
+				}
+			}
+			return fmt.Errorf("peer certificate didn't verify against CAFile and didn't match the configured SPKI pin")
+		}
+	}
+
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}, nil
+}
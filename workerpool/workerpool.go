@@ -0,0 +1,36 @@
+// Package workerpool provides a small bounded-concurrency gate, used to cap
+// how many printers may stream gcode (or otherwise do heavy work) at the
+// same time.
+package workerpool
+
+// Pool limits the number of concurrent tasks that may run at once. The zero
+// value is not usable; construct with New.
+type Pool struct {
+	tokens chan struct{}
+}
+
+// New returns a Pool that allows at most size concurrent tasks. A size <= 0
+// is treated as 1.
+func New(size int) *Pool {
+	if size <= 0 {
+		size = 1
+	}
+	return &Pool{tokens: make(chan struct{}, size)}
+}
+
+// Acquire blocks until a slot is available.
+func (p *Pool) Acquire() {
+	p.tokens <- struct{}{}
+}
+
+// Release frees a slot previously obtained with Acquire.
+func (p *Pool) Release() {
+	<-p.tokens
+}
+
+// Do runs fn with a slot held, blocking until one is free.
+func (p *Pool) Do(fn func()) {
+	p.Acquire()
+	defer p.Release()
+	fn()
+}